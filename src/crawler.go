@@ -3,19 +3,22 @@ package dcrawl
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
-	"github.com/go-redis/redis"
 	"github.com/goware/urlx"
 	"github.com/pkg/errors"
 	"github.com/schollz/collectlinks"
@@ -39,13 +42,18 @@ type Settings struct {
 	AllowHashParameters  bool
 	DontFollowLinks      bool
 	RequirePluck         bool
+	// PerHostDelay overrides robots.txt's Crawl-Delay (and the built-in
+	// default) as the minimum time between requests to any one host. Zero
+	// means "use robots.txt / the default instead".
+	PerHostDelay time.Duration
 }
 
 // Crawler is the crawler instance
 type Crawler struct {
 	// Instance options
-	RedisURL                 string
-	RedisPort                string
+	RedisAddr                string
+	QueueBackend             string
+	QueueDir                 string
 	MaxNumberConnections     int
 	MaxNumberWorkers         int
 	MaximumNumberOfErrors    int
@@ -57,6 +65,12 @@ type Crawler struct {
 	Cookie                   string
 	EraseDB                  bool
 	MaxQueueSize             int
+	LocalCacheSize           int
+	BloomFilterSize          uint
+	BloomFalsePositiveRate   float64
+	DoingLeaseTTL            time.Duration
+	DoingReapInterval        time.Duration
+	DumpBatchSize            int
 
 	// Public  options
 	Settings Settings
@@ -70,11 +84,17 @@ type Crawler struct {
 	numDoing           int64
 	isRunning          bool
 	errors             int64
+	cacheHits          int64
+	cacheMisses        int64
 	client             *http.Client
-	todo               *redis.Client
-	doing              *redis.Client
-	done               *redis.Client
-	trash              *redis.Client
+	todo               QueueStore
+	doing              QueueStore
+	done               QueueStore
+	trash              QueueStore
+	robots             QueueStore
+	throttle           QueueStore
+	hostBackoff        *hostBackoffMap
+	seen               *seenCache
 	wg                 sync.WaitGroup
 	queue              *syncmap
 	workersWorking     bool
@@ -92,8 +112,14 @@ func New() (*Crawler, error) {
 	c := new(Crawler)
 	c.MaxNumberConnections = 20
 	c.MaxNumberWorkers = 8
-	c.RedisURL = "127.0.0.1"
-	c.RedisPort = "6379"
+	c.RedisAddr = "127.0.0.1:6379"
+	c.QueueBackend = "redis"
+	c.QueueDir = "dcrawl-data"
+	c.LocalCacheSize = 100000
+	c.BloomFalsePositiveRate = 0.01
+	c.DoingLeaseTTL = 5 * time.Minute
+	c.DoingReapInterval = 30 * time.Second
+	c.DumpBatchSize = 1000
 	c.TimeIntervalToPrintStats = 1
 	c.MaximumNumberOfErrors = 20
 	c.errors = 0
@@ -105,32 +131,76 @@ func New() (*Crawler, error) {
 	return c, err
 }
 
-// Init initializes the connection pool and the Redis client
+// connectQueueStores dials whichever QueueBackend the Crawler is configured
+// for and returns the four URL queues, the settings store, the robots.txt
+// cache, and the per-host throttle.
+func (c *Crawler) connectQueueStores() (todo, doing, done, trash, settings, robots, throttle QueueStore, err error) {
+	switch c.QueueBackend {
+	case "", "redis":
+		var t, d, dn, tr, s, rb, th redisQueueStore
+		t, d, dn, tr, s, rb, th, err = connectRedisStores(c.RedisAddr)
+		if err != nil {
+			return
+		}
+		_, err = s.client.Ping().Result()
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Redis not available at %s, did you run it? The easiest way is\n\n\tdocker run -d -v `pwd`:/data -p 6379:6379 redis\n\n", c.RedisAddr))
+			return
+		}
+		todo, doing, done, trash, settings, robots, throttle = t, d, dn, tr, s, rb, th
+	case "leveldb":
+		spaces := map[string]*QueueStore{
+			"todo":     &todo,
+			"doing":    &doing,
+			"done":     &done,
+			"trash":    &trash,
+			"settings": &settings,
+			"robots":   &robots,
+			"throttle": &throttle,
+		}
+		for name, dst := range spaces {
+			var store *levelDBQueueStore
+			store, err = newLevelDBQueueStore(filepath.Join(c.QueueDir, name))
+			if err != nil {
+				return
+			}
+			*dst = store
+		}
+	case "memory":
+		todo = newMemoryQueueStore()
+		doing = newMemoryQueueStore()
+		done = newMemoryQueueStore()
+		trash = newMemoryQueueStore()
+		settings = newMemoryQueueStore()
+		robots = newMemoryQueueStore()
+		throttle = newMemoryQueueStore()
+	default:
+		err = errors.New("unknown QueueBackend '" + c.QueueBackend + "', must be 'redis', 'leveldb', or 'memory'")
+	}
+	return
+}
+
+// Init initializes the connection pool and the queue backend
 func (c *Crawler) Init(config ...Settings) (err error) {
-	// connect to Redis for the settings
-	remoteSettings := redis.NewClient(&redis.Options{
-		Addr:     c.RedisURL + ":" + c.RedisPort,
-		Password: "",
-		DB:       4,
-	})
-	_, err = remoteSettings.Ping().Result()
+	todo, doing, done, trash, remoteSettings, robots, throttle, err := c.connectQueueStores()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Redis not available at %s:%s, did you run it? The easiest way is\n\n\tdocker run -d -v `pwd`:/data -p 6379:6379 redis\n\n", c.RedisURL, c.RedisPort))
+		return err
 	}
+
 	if len(config) > 0 {
-		// save the supplied configuration to Redis
+		// save the supplied configuration
 		bSettings, err := json.Marshal(config[0])
-		_, err = remoteSettings.Set("settings", string(bSettings), 0).Result()
+		err = remoteSettings.Set("settings", string(bSettings))
 		if err != nil {
 			return err
 		}
 		log.Infof("saved settings: %v", config[0])
 	}
-	// load the configuration from Redis
+	// load the configuration
 	var val string
-	val, err = remoteSettings.Get("settings").Result()
+	val, err = remoteSettings.Get("settings")
 	if err != nil {
-		return errors.New(fmt.Sprintf("You need to set the base settings. Use\n\n\tdcrawl -s %s -p %s -set -url http://www.URL.com\n\n", c.RedisURL, c.RedisPort))
+		return errors.New("You need to set the base settings. Use\n\n\tdcrawl -set -url http://www.URL.com\n\n")
 	}
 	err = json.Unmarshal([]byte(val), &c.Settings)
 	log.Infof("loaded settings: %v", c.Settings)
@@ -166,35 +236,18 @@ func (c *Crawler) Init(config ...Settings) (err error) {
 		Timeout:   time.Duration(10 * time.Second),
 	}
 
-	// Setup Redis client
-	c.todo = redis.NewClient(&redis.Options{
-		Addr:        c.RedisURL + ":" + c.RedisPort,
-		Password:    "", // no password set
-		DB:          0,  // use default DB
-		ReadTimeout: 30 * time.Second,
-		MaxRetries:  10,
-	})
-	c.doing = redis.NewClient(&redis.Options{
-		Addr:        c.RedisURL + ":" + c.RedisPort,
-		Password:    "", // no password set
-		DB:          1,  // use default DB
-		ReadTimeout: 30 * time.Second,
-		MaxRetries:  10,
-	})
-	c.done = redis.NewClient(&redis.Options{
-		Addr:        c.RedisURL + ":" + c.RedisPort,
-		Password:    "", // no password set
-		DB:          2,  // use default DB
-		ReadTimeout: 30 * time.Second,
-		MaxRetries:  10,
-	})
-	c.trash = redis.NewClient(&redis.Options{
-		Addr:        c.RedisURL + ":" + c.RedisPort,
-		Password:    "", // no password set
-		DB:          3,  // use default DB
-		ReadTimeout: 30 * time.Second,
-		MaxRetries:  10,
-	})
+	c.todo = todo
+	c.doing = doing
+	c.done = done
+	c.trash = trash
+	c.robots = robots
+	c.throttle = throttle
+	c.hostBackoff = newHostBackoffMap()
+
+	c.seen, err = newSeenCache(c.LocalCacheSize, c.BloomFilterSize, c.BloomFalsePositiveRate)
+	if err != nil {
+		return err
+	}
 
 	if c.EraseDB {
 		log.Info("Flushed database")
@@ -215,33 +268,33 @@ func (c *Crawler) Init(config ...Settings) (err error) {
 
 func (c *Crawler) Redo() (err error) {
 	var keys []string
-	keys, err = c.doing.Keys("*").Result()
+	keys, err = c.doing.Keys("*")
 	if err != nil {
 		return
 	}
 	for _, key := range keys {
 		log.Debugf("Moving %s back to todo list", key)
-		_, err = c.doing.Del(key).Result()
+		err = c.doing.Del(key)
 		if err != nil {
 			log.Error(err.Error())
 		}
-		_, err = c.todo.Set(key, "", 0).Result()
+		err = c.todo.Set(key, "")
 		if err != nil {
 			log.Error(err.Error())
 		}
 	}
 
-	keys, err = c.trash.Keys("*").Result()
+	keys, err = c.trash.Keys("*")
 	if err != nil {
 		return
 	}
 	for _, key := range keys {
 		log.Debugf("Moving %s back to todo list", key)
-		_, err = c.trash.Del(key).Result()
+		err = c.trash.Del(key)
 		if err != nil {
 			log.Error(err.Error())
 		}
-		_, err = c.todo.Set(key, "", 0).Result()
+		err = c.todo.Set(key, "")
 		if err != nil {
 			log.Error(err.Error())
 		}
@@ -250,126 +303,139 @@ func (c *Crawler) Redo() (err error) {
 	return
 }
 
-func (c *Crawler) DumpMap() (m map[string]string, err error) {
-	log.Info("Dumping...")
-	totalSize := int64(0)
-	var tempSize int64
-	tempSize, _ = c.done.DbSize().Result()
-	totalSize = tempSize * 2
-	bar := progressbar.NewOptions64(totalSize,
-		progressbar.OptionShowIts(),
-		progressbar.OptionShowCount(),
-	)
-
-	var keySize int64
-	var keys []string
-	keySize, _ = c.done.DbSize().Result()
-	keys = make([]string, keySize+10000)
-	i := 0
-	iter := c.done.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Add(1)
-		keys[i] = iter.Val()
-		i++
+// dumpRecord is the shape DumpStream writes one per line/row/envelope: the
+// URL, which space it's currently filed under, and (for a 'done' URL) the
+// JSON plucked from it.
+type dumpRecord struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+	Pluck string `json:"pluck,omitempty"`
+}
+
+// DumpStream writes every URL dcrawl knows about - across todo, doing,
+// done, and trash - to w one record at a time via Scan cursors, instead of
+// buffering the whole database in memory the way Dump/DumpMap used to.
+// format is one of "ndjson" (the default), "csv", or "warc".
+func (c *Crawler) DumpStream(ctx context.Context, w io.Writer, format string) error {
+	return c.dumpSpaces(ctx, w, format, []string{"todo", "doing", "done", "trash"})
+}
+
+// dumpSpaces is DumpStream's implementation, parameterized over which
+// spaces to walk so DumpMap/Dump can reuse it for their narrower needs
+// without buffering records they don't want.
+func (c *Crawler) dumpSpaces(ctx context.Context, w io.Writer, format string, spaceNames []string) (err error) {
+	bw := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+	switch format {
+	case "", "ndjson", "warc":
+	case "csv":
+		csvWriter = csv.NewWriter(bw)
+		err = csvWriter.Write([]string{"url", "state", "pluck"})
+	default:
+		err = errors.New("unknown DumpStream format '" + format + "', must be 'ndjson', 'csv', or 'warc'")
 	}
-	keys = keys[:i]
-	if err = iter.Err(); err != nil {
-		log.Error("Problem getting done")
+	if err != nil {
 		return
 	}
-	m = make(map[string]string)
-	for _, key := range keys {
-		bar.Add(1)
-		var val string
-		val, err = c.done.Get(key).Result()
+
+	err = c.walkSpaces(ctx, spaceNames, func(rec dumpRecord) (err error) {
+		switch format {
+		case "csv":
+			err = csvWriter.Write([]string{rec.URL, rec.State, rec.Pluck})
+		case "warc":
+			err = writeWARCRecord(bw, rec)
+		default:
+			err = json.NewEncoder(bw).Encode(rec)
+		}
 		if err != nil {
-			return
+			return err
 		}
-		m[key] = val
-	}
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err = csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
 	return
 }
 
-func (c *Crawler) Dump() (allKeys []string, err error) {
-	log.Info("Dumping...")
-	allKeys = make([]string, 0)
-	var keySize int64
-	var keys []string
+// walkSpaces scans spaceNames in order, calling fn once per record without
+// ever holding more than one in memory at a time. DumpStream (via
+// dumpSpaces) uses it to serialize records as it goes; DumpMap/Dump use it
+// directly to fill their map/slice, skipping the serialize step entirely
+// since they don't need it.
+func (c *Crawler) walkSpaces(ctx context.Context, spaceNames []string, fn func(dumpRecord) error) error {
+	stores := map[string]QueueStore{
+		"todo":  c.todo,
+		"doing": c.doing,
+		"done":  c.done,
+		"trash": c.trash,
+	}
+
+	for _, name := range spaceNames {
+		iter := stores[name].ScanBatch(c.DumpBatchSize)
+		for iter.Next() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
 
-	totalSize := int64(0)
-	var tempSize int64
-	tempSize, _ = c.todo.DbSize().Result()
-	totalSize += tempSize
-	tempSize, _ = c.done.DbSize().Result()
-	totalSize += tempSize
-	tempSize, _ = c.doing.DbSize().Result()
-	totalSize += tempSize
-	tempSize, _ = c.trash.DbSize().Result()
-	totalSize += tempSize
-	bar := progressbar.NewOptions64(totalSize,
-		progressbar.OptionShowIts(),
-		progressbar.OptionShowCount(),
-	)
-
-	keySize, _ = c.todo.DbSize().Result()
-	keys = make([]string, keySize*2)
-	i := 0
-	iter := c.todo.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Add(1)
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		log.Error("Problem getting todo")
-		return nil, err
-	}
-	allKeys = append(allKeys, keys[:i]...)
+			rec := dumpRecord{URL: iter.Val(), State: name}
+			if name == "done" {
+				pluck, err := stores[name].Get(rec.URL)
+				if err != nil && err != ErrKeyNotFound {
+					return err
+				}
+				rec.Pluck = pluck
+			}
 
-	keySize, _ = c.doing.DbSize().Result()
-	keys = make([]string, keySize*2)
-	i = 0
-	iter = c.doing.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Add(1)
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		log.Error("Problem getting doing")
-		return nil, err
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
 	}
-	allKeys = append(allKeys, keys[:i]...)
+	return nil
+}
 
-	keySize, _ = c.done.DbSize().Result()
-	keys = make([]string, keySize*2)
-	i = 0
-	iter = c.done.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Add(1)
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		log.Error("Problem getting done")
-		return nil, err
-	}
-	allKeys = append(allKeys, keys[:i]...)
+// writeWARCRecord writes rec as a minimal WARC-style envelope: a WARC/1.0
+// header block, a blank line, and the record's plucked payload.
+func writeWARCRecord(w io.Writer, rec dumpRecord) error {
+	_, err := fmt.Fprintf(w, "WARC/1.0\r\nWARC-Type: resource\r\nWARC-Target-URI: %s\r\nWARC-Record-State: %s\r\nContent-Length: %d\r\n\r\n%s\r\n\r\n",
+		rec.URL, rec.State, len(rec.Pluck), rec.Pluck)
+	return err
+}
 
-	keySize, _ = c.trash.DbSize().Result()
-	keys = make([]string, keySize*2)
-	i = 0
-	iter = c.trash.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Add(1)
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		log.Error("Problem getting trash")
-		return nil, err
-	}
-	allKeys = append(allKeys, keys[:i]...)
+// DumpMap returns every URL currently in 'done' along with its plucked
+// data. It's a thin wrapper around the same Scan-cursor walk DumpStream
+// uses, kept for backward compatibility; call DumpStream directly on a
+// large crawl to avoid buffering the whole result in memory.
+func (c *Crawler) DumpMap() (m map[string]string, err error) {
+	log.Info("Dumping...")
+	m = make(map[string]string)
+	err = c.walkSpaces(context.Background(), []string{"done"}, func(rec dumpRecord) error {
+		m[rec.URL] = rec.Pluck
+		return nil
+	})
+	return
+}
+
+// Dump returns every URL dcrawl knows about, across all four spaces. It's
+// a thin wrapper around the same Scan-cursor walk DumpStream uses, kept
+// for backward compatibility; call DumpStream directly on a large crawl to
+// avoid buffering every key in memory.
+func (c *Crawler) Dump() (allKeys []string, err error) {
+	log.Info("Dumping...")
+	allKeys = make([]string, 0)
+	err = c.walkSpaces(context.Background(), []string{"todo", "doing", "done", "trash"}, func(rec dumpRecord) error {
+		allKeys = append(allKeys, rec.URL)
+		return nil
+	})
 	return
 }
 
@@ -399,45 +465,56 @@ func (c *Crawler) getIP() (ip string, err error) {
 
 func (c *Crawler) addLinkToDo(link string, force bool) (err error) {
 	if !force {
+		// the local cache short-circuits the four Redis round-trips below:
+		// a link it holds has already been filed into one of the four
+		// spaces, so there's nothing to check (a Bloom filter false
+		// positive skips a new link the same way)
+		if c.seen != nil && c.seen.MaybeSeen(link) {
+			c.cacheHits++
+			return
+		}
+		c.cacheMisses++
+
 		// add only if it isn't already in one of the databases
-		_, err = c.todo.Get(link).Result()
-		if err != redis.Nil {
+		_, err = c.todo.Get(link)
+		if err != ErrKeyNotFound {
 			return
 		}
-		_, err = c.doing.Get(link).Result()
-		if err != redis.Nil {
+		_, err = c.doing.Get(link)
+		if err != ErrKeyNotFound {
 			return
 		}
-		_, err = c.done.Get(link).Result()
-		if err != redis.Nil {
+		_, err = c.done.Get(link)
+		if err != ErrKeyNotFound {
 			return
 		}
-		_, err = c.trash.Get(link).Result()
-		if err != redis.Nil {
+		_, err = c.trash.Get(link)
+		if err != ErrKeyNotFound {
 			return
 		}
 	}
 
 	// add it to the todo list
-	err = c.todo.Set(link, "", 0).Err()
+	err = c.todo.Set(link, "")
+	c.seen.Add(link)
 	return
 }
 
 // Flush erases the database
 func (c *Crawler) Flush() (err error) {
-	_, err = c.todo.FlushAll().Result()
+	err = c.todo.FlushAll()
 	if err != nil {
 		return
 	}
-	_, err = c.done.FlushAll().Result()
+	err = c.done.FlushAll()
 	if err != nil {
 		return
 	}
-	_, err = c.doing.FlushAll().Result()
+	err = c.doing.FlushAll()
 	if err != nil {
 		return
 	}
-	_, err = c.trash.FlushAll().Result()
+	err = c.trash.FlushAll()
 	if err != nil {
 		return
 	}
@@ -470,10 +547,22 @@ func (c *Crawler) scrapeLinks(url string) (linkCandidates []string, pluckedData
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 429 || resp.StatusCode == 503 {
+		// the host is asking us to slow down, not rejecting the URL: back
+		// off its bucket and give the URL back to 'todo' instead of
+		// trashing it.
+		if host, errHost := urlHost(url); errHost == nil {
+			c.backoffHost(host)
+		}
+		c.doing.Del(url)
+		c.todo.Set(url, "")
+		return
+	}
+
 	if resp.StatusCode != 200 {
-		c.doing.Del(url).Result()
-		c.todo.Del(url).Result()
-		c.trash.Set(url, "", 0).Result()
+		c.doing.Del(url)
+		c.todo.Del(url)
+		c.trash.Set(url, "")
 		if resp.StatusCode == 403 {
 			c.errors++
 			if c.errors > int64(c.MaximumNumberOfErrors) {
@@ -578,6 +667,11 @@ func (c *Crawler) scrapeLinks(url string) (linkCandidates []string, pluckedData
 			continue
 		}
 
+		// robots.txt gets the last word before a link is queued
+		if !c.allowedByRobots(normalizedLink) {
+			continue
+		}
+
 		// If it passed all the tests, add to link candidates
 		linkCandidates[linkCandidatesI] = normalizedLink
 		linkCandidatesI++
@@ -593,16 +687,30 @@ func (c *Crawler) crawl(id int, jobs chan string) {
 	for {
 		randomURL := <-jobs
 		log.Debugf("%d processing %s", id, randomURL)
+
+		// skip (and requeue) URLs whose host bucket isn't ready yet,
+		// rather than scraping ahead of the host's rate limit
+		if host, errHost := urlHost(randomURL); errHost == nil && !c.hostReady(host) {
+			log.Debugf("%d deferring %s, host not ready", id, randomURL)
+			if errDel := c.doing.Del(randomURL); errDel != nil {
+				log.Error(errDel.Error())
+			}
+			if errSet := c.todo.Set(randomURL, ""); errSet != nil {
+				log.Error(errSet.Error())
+			}
+			continue
+		}
+
 		// time the link getting process
 		urls, pluckedData, err := c.scrapeLinks(randomURL)
 		if err != nil {
 			log.Warn(errors.Wrap(err, "worker #"+strconv.Itoa(id)+" failed scraping, will retry"))
 			// move url to back to 'todo'
-			_, err2 := c.doing.Del(randomURL).Result()
+			err2 := c.doing.Del(randomURL)
 			if err2 != nil {
 				log.Error(err2.Error())
 			}
-			_, err2 = c.todo.Set(randomURL, "", 0).Result()
+			err2 = c.todo.Set(randomURL, "")
 			if err2 != nil {
 				log.Error(err2.Error())
 			}
@@ -612,12 +720,12 @@ func (c *Crawler) crawl(id int, jobs chan string) {
 		t := time.Now()
 
 		// move url to 'done'
-		_, err = c.doing.Del(randomURL).Result()
+		err = c.doing.Del(randomURL)
 		if err != nil {
 			log.Warn(errors.Wrap(err, "worker #"+strconv.Itoa(id)))
 			continue
 		}
-		_, err = c.done.Set(randomURL, pluckedData, 0).Result()
+		err = c.done.Set(randomURL, pluckedData)
 		if err != nil {
 			log.Warn(errors.Wrap(err, "worker #"+strconv.Itoa(id)))
 			continue
@@ -673,6 +781,7 @@ func (c *Crawler) Crawl() (err error) {
 	c.numberOfURLSParsed = 0
 	c.isRunning = true
 	go c.contantlyPrintStats()
+	go c.reapStaleDoing()
 
 	var jobs chan string = make(chan string)
 	for w := 0; w < c.MaxNumberWorkers; w++ {
@@ -683,14 +792,14 @@ func (c *Crawler) Crawl() (err error) {
 	for {
 		time.Sleep(1 * time.Second)
 
-		currentDoing, _ := c.doing.DbSize().Result()
+		currentDoing, _ := c.doing.Size()
 		if int(currentDoing) > c.MaxQueueSize {
 			time.Sleep(3 * time.Second)
 			continue
 		}
 
 		// check if there are any links to do
-		dbsize, err := c.todo.DbSize().Result()
+		dbsize, err := c.todo.Size()
 		if err != nil {
 			log.Error(err)
 		}
@@ -709,42 +818,21 @@ func (c *Crawler) Crawl() (err error) {
 			haveResults = true
 		}
 
-		urlsToDoMap := make(map[string]struct{})
-		for i := 0; i < c.MaxNumberWorkers; i++ {
-			key, errRandom := c.todo.RandomKey().Result()
-			if errRandom != nil {
-				log.Warn(errRandom)
-			}
-			urlsToDoMap[key] = struct{}{}
-			log.Debugf("adding %s to urls to do", key)
-		}
-		urlsToDo := make([]string, len(urlsToDoMap))
-		i := 0
-		for key := range urlsToDoMap {
-			urlsToDo[i] = key
-			i++
+		// pop urls out of 'todo' and into 'doing' with a lease timestamp. In
+		// single-node and Sentinel Redis this is one atomic step, so a crash
+		// between the two can't strand or duplicate a URL the way a separate
+		// RandomKeys+Del+MSet would; Cluster, LevelDB and memory backends do
+		// a separate delete then write (see PopRandomInto)
+		leasedAt := strconv.FormatInt(time.Now().Unix(), 10)
+		urlsToDo, errPop := c.todo.PopRandomInto(c.doing, c.MaxNumberWorkers, leasedAt)
+		if errPop != nil {
+			log.Error(errors.Wrap(errPop, "problem moving urls from todo to doing"))
 		}
 		if len(urlsToDo) == 0 {
 			log.Debug("nevermind, no urls todo")
 			continue
 		}
-
-		// move to 'doing'
-		log.Debugf("moving %d urls from todo to doing", len(urlsToDo))
-		_, err = c.todo.Del(urlsToDo...).Result()
-		if err != nil {
-			log.Error(errors.Wrap(err, "problem removing from todo"))
-		}
-		pairs := make([]interface{}, len(urlsToDo)*2)
-		for i := 0; i < len(urlsToDo)*2; i += 2 {
-			pairs[i] = urlsToDo[i/2]
-			pairs[i+1] = ""
-		}
-
-		_, err = c.doing.MSet(pairs...).Result()
-		if err != nil {
-			log.Error(errors.Wrap(err, "problem placing in doing"))
-		}
+		log.Debugf("moved %d urls from todo to doing", len(urlsToDo))
 
 		for _, j := range urlsToDo {
 			log.Debugf("Adding job %s", j)
@@ -770,19 +858,19 @@ func round(f float64) int {
 
 func (c *Crawler) updateListCounts() (err error) {
 	// Update stats
-	c.numToDo, err = c.todo.DbSize().Result()
+	c.numToDo, err = c.todo.Size()
 	if err != nil {
 		return
 	}
-	c.numDoing, err = c.doing.DbSize().Result()
+	c.numDoing, err = c.doing.Size()
 	if err != nil {
 		return
 	}
-	c.numDone, err = c.done.DbSize().Result()
+	c.numDone, err = c.done.Size()
 	if err != nil {
 		return
 	}
-	c.numTrash, err = c.trash.DbSize().Result()
+	c.numTrash, err = c.trash.Size()
 	if err != nil {
 		return
 	}
@@ -802,6 +890,58 @@ func (c *Crawler) contantlyPrintStats() {
 	}
 }
 
+// reapStaleDoing periodically scans 'doing' for leases older than
+// DoingLeaseTTL and moves them back to 'todo' via MoveInto, so a worker (or
+// a whole dcrawl process) that crashed mid-fetch doesn't strand its URLs
+// forever - previously only a manual call to Redo recovered them. In
+// single-node and Sentinel mode MoveInto does this atomically, closing the
+// same crash-between-steps window PopRandomInto closes for the initial
+// todo->doing pop. In Cluster mode MoveInto has no atomic path (see its
+// doc comment in queuestore.go) and falls back to a separate delete-then-set,
+// so a crash between those two calls can still drop a lease in Cluster mode.
+func (c *Crawler) reapStaleDoing() {
+	for {
+		time.Sleep(c.DoingReapInterval)
+		if err := c.reapOnce(); err != nil {
+			log.Error(errors.Wrap(err, "problem reaping stale doing entries"))
+		}
+		if !c.isRunning {
+			return
+		}
+	}
+}
+
+func (c *Crawler) reapOnce() (err error) {
+	var stale []string
+	iter := c.doing.Scan()
+	for iter.Next() {
+		key := iter.Val()
+		val, errGet := c.doing.Get(key)
+		if errGet != nil {
+			continue
+		}
+		leasedAt, errParse := strconv.ParseInt(val, 10, 64)
+		if errParse != nil {
+			// not a lease timestamp (e.g. left over from before this
+			// backend ran the reaper); leave it alone
+			continue
+		}
+		if time.Since(time.Unix(leasedAt, 0)) > c.DoingLeaseTTL {
+			stale = append(stale, key)
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return
+	}
+	if len(stale) > 0 {
+		log.Debugf("lease expired, moving %d urls back to todo", len(stale))
+		if errMove := c.doing.MoveInto(c.todo, stale, ""); errMove != nil {
+			log.Error(errors.Wrap(errMove, "problem moving stale leases back to todo"))
+		}
+	}
+	return nil
+}
+
 func (c *Crawler) printStats() {
 	URLSPerSecond := round(60.0 * float64(c.numberOfURLSParsed) / float64(time.Since(c.programTime).Seconds()))
 	printURL := strings.Replace(c.Settings.BaseURL, "https://", "", 1)
@@ -809,7 +949,7 @@ func (c *Crawler) printStats() {
 	if len(printURL) > 17 {
 		printURL = printURL[:17]
 	}
-	log.Infof("[%s] parsed:%s, rate:%d, todo:%s, done:%s, doing:%s, trash:%s, errors:%s",
+	log.Infof("[%s] parsed:%s, rate:%d, todo:%s, done:%s, doing:%s, trash:%s, errors:%s, cachehits:%s, cachemisses:%s",
 		printURL,
 		humanize.Comma(int64(c.numberOfURLSParsed)),
 		URLSPerSecond,
@@ -817,5 +957,7 @@ func (c *Crawler) printStats() {
 		humanize.Comma(int64(c.numDone)),
 		humanize.Comma(int64(c.numDoing)),
 		humanize.Comma(int64(c.numTrash)),
-		humanize.Comma(int64(c.errors)))
+		humanize.Comma(int64(c.errors)),
+		humanize.Comma(c.cacheHits),
+		humanize.Comma(c.cacheMisses))
 }
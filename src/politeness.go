@@ -0,0 +1,148 @@
+package dcrawl
+
+import (
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/schollz/logger"
+	"github.com/temoto/robotstxt"
+)
+
+// defaultHostDelay is the minimum time between requests to a host that sets
+// no Crawl-Delay and has no Settings.PerHostDelay override.
+const defaultHostDelay = 1 * time.Second
+
+// maxHostBackoff caps the exponential backoff applied to a host after it
+// answers with 429 or 503, so a host that stays unhappy doesn't push its
+// delay out indefinitely.
+const maxHostBackoff = 5 * time.Minute
+
+// hostBackoffMap tracks the current backoff duration per host, local to
+// this process. It only ever grows a host's delay beyond hostDelay(); the
+// shared "next allowed" time itself lives in the throttle QueueStore so
+// it's honored across worker processes too.
+type hostBackoffMap struct {
+	sync.Mutex
+	data map[string]time.Duration
+}
+
+func newHostBackoffMap() *hostBackoffMap {
+	return &hostBackoffMap{data: make(map[string]time.Duration)}
+}
+
+// robotsFor returns host's parsed robots.txt, fetching and caching it (even
+// the "no robots.txt" case, so a missing file doesn't trigger a fetch per
+// link) the first time it's needed.
+func (c *Crawler) robotsFor(host string) (*robotstxt.RobotsData, error) {
+	body, err := c.robots.Get(host)
+	if err == ErrKeyNotFound {
+		body = c.fetchRobotsTxt(host)
+		if errSet := c.robots.Set(host, body); errSet != nil {
+			log.Error(errors.Wrap(errSet, "problem caching robots.txt for "+host))
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return robotstxt.FromString(body)
+}
+
+// fetchRobotsTxt fetches host's robots.txt, treating any non-200 response
+// (including a failed request) as "no robots.txt", the same as robots.txt
+// itself specifies for a missing file.
+func (c *Crawler) fetchRobotsTxt(host string) string {
+	resp, err := c.client.Get("http://" + host + "/robots.txt")
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return ""
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return string(body)
+}
+
+// urlHost extracts the host (with port, if any) a URL would be fetched
+// from.
+func urlHost(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
+
+// allowedByRobots reports whether link's host's robots.txt permits fetching
+// it with the crawler's UserAgent. A robots.txt that can't be fetched or
+// parsed is treated as allow-all.
+func (c *Crawler) allowedByRobots(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return true
+	}
+	robots, err := c.robotsFor(u.Host)
+	if err != nil {
+		return true
+	}
+	return robots.FindGroup(c.UserAgent).Test(u.Path)
+}
+
+// hostDelay returns the minimum delay dcrawl should leave between requests
+// to host: Settings.PerHostDelay if set, otherwise robots.txt's Crawl-Delay,
+// otherwise defaultHostDelay.
+func (c *Crawler) hostDelay(host string) time.Duration {
+	if c.Settings.PerHostDelay > 0 {
+		return c.Settings.PerHostDelay
+	}
+	robots, err := c.robotsFor(host)
+	if err == nil {
+		if group := robots.FindGroup(c.UserAgent); group.CrawlDelay > 0 {
+			return group.CrawlDelay
+		}
+	}
+	return defaultHostDelay
+}
+
+// hostReady reports whether host's per-host token bucket is ready for
+// another request, reserving the slot in the same call so a concurrent
+// worker (in this process or another) can't also pass the check before this
+// one uses it.
+func (c *Crawler) hostReady(host string) bool {
+	ok, err := c.throttle.Reserve(host, time.Now(), c.hostDelay(host))
+	if err != nil {
+		log.Error(errors.Wrap(err, "problem checking host throttle for "+host))
+		return true
+	}
+	return ok
+}
+
+// backoffHost is called when host answers with 429 or 503: instead of
+// dumping the URL in trash, it pushes host's next allowed request further
+// out, doubling the backoff each time host does so, up to maxHostBackoff.
+// A host's backoff is kept for the life of the process and is not reset
+// when the host later answers normally.
+func (c *Crawler) backoffHost(host string) {
+	c.hostBackoff.Lock()
+	delay := c.hostBackoff.data[host]
+	if delay == 0 {
+		delay = c.hostDelay(host)
+	} else {
+		delay *= 2
+		if delay > maxHostBackoff {
+			delay = maxHostBackoff
+		}
+	}
+	c.hostBackoff.data[host] = delay
+	c.hostBackoff.Unlock()
+
+	if err := c.throttle.Set(host, strconv.FormatInt(time.Now().Add(delay).UnixNano(), 10)); err != nil {
+		log.Error(errors.Wrap(err, "problem backing off host "+host))
+	}
+}
@@ -0,0 +1,833 @@
+package dcrawl
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// ErrKeyNotFound is returned by a QueueStore's Get/RandomKey when the key
+// (or the whole store) is empty. It plays the role that redis.Nil plays
+// for the Redis backend, but is backend-independent.
+var ErrKeyNotFound = errors.New("key not found")
+
+// QueueStore abstracts the storage backing one of dcrawl's logical URL
+// queues (todo/doing/done/trash). Redis is the production backend for
+// multi-process crawls; LevelDB and an in-memory map are provided for
+// single-host use without any external dependency.
+type QueueStore interface {
+	Get(key string) (string, error)
+	Set(key, val string) error
+	Del(keys ...string) error
+	MSet(pairs map[string]string) error
+	Keys(pattern string) ([]string, error)
+	RandomKey() (string, error)
+	RandomKeys(n int) ([]string, error)
+	Size() (int64, error)
+	FlushAll() error
+	Scan() QueueIterator
+	// ScanBatch is Scan with the backend's server-side page size made
+	// explicit, so a streaming dump can trade off round-trips against
+	// per-call memory; batchSize <= 0 means "use the backend's default".
+	ScanBatch(batchSize int) QueueIterator
+	// PopRandomInto atomically pops up to n keys at random out of the
+	// store and writes them into dst with val as their value (dcrawl uses
+	// this to hand URLs from todo to doing with a lease timestamp, without
+	// the pop-then-write race a separate RandomKeys+Del+MSet would have).
+	PopRandomInto(dst QueueStore, n int, val string) (moved []string, err error)
+	// MoveInto atomically moves the given (already-known) keys out of the
+	// store and writes them into dst with val as their value. dcrawl uses
+	// this to recover stale doing leases back into todo: unlike
+	// PopRandomInto, the keys to move are already decided by the caller
+	// (a lease-expiry scan), so there's no pop step to race - only the
+	// delete-from-src and write-to-dst need to happen as one unit, so a
+	// crash can't drop a key that's been removed from src but never made
+	// it into dst.
+	MoveInto(dst QueueStore, keys []string, val string) error
+	// Reserve implements a per-key token bucket: if now is at or after the
+	// key's stored "next allowed" time (a missing key is always eligible),
+	// it atomically sets that time to now plus delay and returns true; otherwise
+	// it leaves the key untouched and returns false. dcrawl uses this on
+	// the throttle store to rate-limit requests per host, shared across
+	// whichever processes point at the same store.
+	Reserve(key string, now time.Time, delay time.Duration) (bool, error)
+}
+
+// genericPopRandomInto implements PopRandomInto in terms of a store's other
+// methods. It's correct for backends where dcrawl only ever runs as a
+// single process anyway (LevelDB, in-memory), so there's no other process
+// that could observe the pop and the write as separate steps.
+func genericPopRandomInto(src, dst QueueStore, n int, val string) (moved []string, err error) {
+	moved, err = src.RandomKeys(n)
+	if err != nil || len(moved) == 0 {
+		return
+	}
+	if err = src.Del(moved...); err != nil {
+		return
+	}
+	pairs := make(map[string]string, len(moved))
+	for _, k := range moved {
+		pairs[k] = val
+	}
+	err = dst.MSet(pairs)
+	return
+}
+
+// genericMoveInto implements MoveInto in terms of a store's other methods.
+// Like genericPopRandomInto, it's only safe where dcrawl runs as a single
+// process, since the delete and the write are two separate round-trips.
+func genericMoveInto(src, dst QueueStore, keys []string, val string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := src.Del(keys...); err != nil {
+		return err
+	}
+	pairs := make(map[string]string, len(keys))
+	for _, k := range keys {
+		pairs[k] = val
+	}
+	return dst.MSet(pairs)
+}
+
+// QueueIterator walks every key in a QueueStore.
+type QueueIterator interface {
+	Next() bool
+	Val() string
+	Err() error
+}
+
+// matchKeyPattern supports the small subset of redis KEYS-style globbing
+// that dcrawl actually uses: "*" (match everything) and "prefix*".
+func matchKeyPattern(pattern, key string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(key, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == key
+}
+
+// redisConnKind identifies which go-redis client constructor a RedisAddr
+// resolves to.
+type redisConnKind int
+
+const (
+	redisConnSingle redisConnKind = iota
+	redisConnSentinel
+	redisConnCluster
+)
+
+// parseRedisAddr parses a dcrawl Redis connection string. The common case is
+// a bare "host:port" for a single local instance. For Sentinel or Cluster
+// deployments it accepts a space-separated list of key=value fields, e.g.
+//
+//	addrs=host1:6379,host2:6379 master_name=mymaster db=0 password=secret
+//
+// master_name selects Sentinel (via NewFailoverClient); two or more addrs
+// with no master_name selects Cluster (via NewClusterClient); anything else
+// falls back to a single plain client. There's no sentinel_password field:
+// the go-redis v6 line this repo is pinned to has no way to AUTH against
+// the Sentinels themselves, only against the master/replicas they point at.
+//
+// db (single-node/Sentinel only; Cluster has no SELECT and ignores it) is a
+// base offset added to each of the seven spaces' own DB index, so two
+// dcrawl deployments pointed at the same Redis instance can set different
+// db= values to avoid colliding on the same DBs.
+
+func parseRedisAddr(addr string) (kind redisConnKind, addrs []string, masterName, password string, db int, err error) {
+	addr = strings.TrimSpace(addr)
+	if !strings.Contains(addr, "=") {
+		addrs = []string{addr}
+		return
+	}
+	for _, field := range strings.Fields(addr) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			err = errors.New("invalid RedisAddr field: " + field)
+			return
+		}
+		key, val := kv[0], kv[1]
+		switch key {
+		case "addrs":
+			addrs = strings.Split(val, ",")
+		case "master_name":
+			masterName = val
+		case "password":
+			password = val
+		case "db":
+			db, err = strconv.Atoi(val)
+			if err != nil {
+				return
+			}
+		default:
+			err = errors.New("unknown RedisAddr field: " + key)
+			return
+		}
+	}
+	if len(addrs) == 0 {
+		err = errors.New("RedisAddr must set addrs=host:port[,host:port...]")
+		return
+	}
+	switch {
+	case masterName != "":
+		kind = redisConnSentinel
+	case len(addrs) > 1:
+		kind = redisConnCluster
+	}
+	return
+}
+
+// redisQueueStore is a QueueStore backed by Redis. In single-node and
+// Sentinel mode each space gets its own numbered Redis DB and keys are
+// unprefixed; Redis Cluster has no SELECT, so in cluster mode every space
+// shares one client and is told apart by a key prefix instead.
+type redisQueueStore struct {
+	client redis.Cmdable
+	prefix string
+	db     int
+}
+
+// connectRedisStores dials Redis (plain, Sentinel, or Cluster, depending on
+// addr) and returns the spaces dcrawl needs: the four URL queues, the
+// settings store, the robots.txt cache, and the per-host throttle.
+func connectRedisStores(addr string) (todo, doing, done, trash, settings, robots, throttle redisQueueStore, err error) {
+	kind, addrs, masterName, password, baseDB, err := parseRedisAddr(addr)
+	if err != nil {
+		return
+	}
+
+	var cluster redis.Cmdable
+	if kind == redisConnCluster {
+		cluster = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:       addrs,
+			Password:    password,
+			ReadTimeout: 30 * time.Second,
+			MaxRetries:  10,
+		})
+	}
+
+	newStore := func(db int, prefix string) redisQueueStore {
+		if kind == redisConnCluster {
+			return redisQueueStore{client: cluster, prefix: prefix}
+		}
+		if kind == redisConnSentinel {
+			return redisQueueStore{db: db, client: redis.NewFailoverClient(&redis.FailoverOptions{
+				MasterName:    masterName,
+				SentinelAddrs: addrs,
+				Password:      password,
+				DB:            db,
+				ReadTimeout:   30 * time.Second,
+				MaxRetries:    10,
+			})}
+		}
+		return redisQueueStore{db: db, client: redis.NewClient(&redis.Options{
+			Addr:        addrs[0],
+			Password:    password,
+			DB:          db,
+			ReadTimeout: 30 * time.Second,
+			MaxRetries:  10,
+		})}
+	}
+
+	todo = newStore(baseDB+0, "todo:")
+	doing = newStore(baseDB+1, "doing:")
+	done = newStore(baseDB+2, "done:")
+	trash = newStore(baseDB+3, "trash:")
+	settings = newStore(baseDB+4, "settings:")
+	robots = newStore(baseDB+5, "robots:")
+	throttle = newStore(baseDB+6, "throttle:")
+	return
+}
+
+func (s redisQueueStore) key(k string) string {
+	return s.prefix + k
+}
+
+func (s redisQueueStore) unkey(k string) string {
+	return strings.TrimPrefix(k, s.prefix)
+}
+
+func (s redisQueueStore) Get(key string) (string, error) {
+	val, err := s.client.Get(s.key(key)).Result()
+	if err == redis.Nil {
+		err = ErrKeyNotFound
+	}
+	return val, err
+}
+
+func (s redisQueueStore) Set(key, val string) error {
+	return s.client.Set(s.key(key), val, 0).Err()
+}
+
+func (s redisQueueStore) Del(keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = s.key(k)
+	}
+	return s.client.Del(prefixed...).Err()
+}
+
+func (s redisQueueStore) MSet(pairs map[string]string) error {
+	args := make([]interface{}, 0, len(pairs)*2)
+	for k, v := range pairs {
+		args = append(args, s.key(k), v)
+	}
+	return s.client.MSet(args...).Err()
+}
+
+func (s redisQueueStore) Keys(pattern string) (keys []string, err error) {
+	var raw []string
+	raw, err = s.client.Keys(s.key(pattern)).Result()
+	if err != nil {
+		return
+	}
+	keys = make([]string, len(raw))
+	for i, k := range raw {
+		keys[i] = s.unkey(k)
+	}
+	return
+}
+
+// RandomKey returns a key at random from the space. In cluster mode there is
+// no per-prefix RANDOMKEY, so the first match of a short scan is used
+// instead.
+func (s redisQueueStore) RandomKey() (string, error) {
+	keys, err := s.RandomKeys(1)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return keys[0], nil
+}
+
+// RandomKeys returns up to n distinct keys picked from the space. In
+// single-node and Sentinel mode it issues RANDOMKEY n times, one round-trip
+// each, so a key drawn twice leaves fewer than n keys; in cluster mode it
+// takes the first n matches of a prefix scan.
+func (s redisQueueStore) RandomKeys(n int) (keys []string, err error) {
+	seen := make(map[string]struct{}, n)
+	if s.prefix == "" {
+		for i := 0; i < n; i++ {
+			k, errRandom := s.client.RandomKey().Result()
+			if errRandom != nil {
+				if errRandom != redis.Nil {
+					err = errRandom
+				}
+				break
+			}
+			seen[k] = struct{}{}
+		}
+	} else {
+		iter := s.client.Scan(0, s.prefix+"*", int64(n*4+10)).Iterator()
+		for iter.Next() && len(seen) < n {
+			seen[s.unkey(iter.Val())] = struct{}{}
+		}
+		err = iter.Err()
+	}
+	keys = make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	return
+}
+
+func (s redisQueueStore) Size() (int64, error) {
+	if s.prefix == "" {
+		return s.client.DBSize().Result()
+	}
+	var n int64
+	iter := s.client.Scan(0, s.prefix+"*", 1000).Iterator()
+	for iter.Next() {
+		n++
+	}
+	return n, iter.Err()
+}
+
+// FlushAll empties the space. In cluster mode this can't use the
+// server-wide FLUSHALL (it would wipe every other space sharing the
+// client), so instead it scans and deletes only the keys under its own
+// prefix.
+func (s redisQueueStore) FlushAll() error {
+	if s.prefix == "" {
+		return s.client.FlushAll().Err()
+	}
+	var keys []string
+	iter := s.client.Scan(0, s.prefix+"*", 1000).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.client.Del(keys...).Err()
+}
+
+type redisQueueIterator struct {
+	store redisQueueStore
+	iter  *redis.ScanIterator
+}
+
+func (s redisQueueStore) Scan() QueueIterator {
+	return s.ScanBatch(0)
+}
+
+// ScanBatch scans with COUNT set to batchSize, giving callers control over
+// how many keys Redis returns per SCAN round-trip; batchSize <= 0 leaves it
+// to Redis's own default.
+func (s redisQueueStore) ScanBatch(batchSize int) QueueIterator {
+	return &redisQueueIterator{store: s, iter: s.client.Scan(0, s.prefix+"*", int64(batchSize)).Iterator()}
+}
+
+func (i *redisQueueIterator) Next() bool  { return i.iter.Next() }
+func (i *redisQueueIterator) Val() string { return i.store.unkey(i.iter.Val()) }
+func (i *redisQueueIterator) Err() error  { return i.iter.Err() }
+
+// popRandomSingleDB moves up to n random keys from one numbered Redis DB to
+// another on the same instance in a single EVAL, so that the pop and the
+// write into the lease DB are atomic: no other dcrawl process can observe
+// the key between the two. It finishes by SELECTing back to the DB it
+// started on (ARGV[1]): go-redis v6 only issues SELECT once, when a pooled
+// connection is first created, and never re-selects per command, so this
+// script's own SELECTs would otherwise leak into whatever DB the
+// connection happened to be left on when it's reused from the pool.
+var popRandomSingleDB = redis.NewScript(`
+local moved = {}
+local seen = {}
+redis.call('SELECT', ARGV[1])
+for i = 1, tonumber(ARGV[3]) do
+	local k = redis.call('RANDOMKEY')
+	if not k then break end
+	if not seen[k] then
+		seen[k] = true
+		redis.call('DEL', k)
+		table.insert(moved, k)
+	end
+end
+redis.call('SELECT', ARGV[2])
+for _, k in ipairs(moved) do
+	redis.call('SET', k, ARGV[4])
+end
+redis.call('SELECT', ARGV[1])
+return moved
+`)
+
+// PopRandomInto moves up to n keys from this space into dst. In single-node
+// and Sentinel mode it does so atomically via popRandomSingleDB, closing
+// the race window a separate RandomKeys+Del+MSet would leave between
+// reading and removing a key. Cluster mode can't use a single EVAL the same
+// way: dcrawl's todo:/doing:/etc. prefixes are deliberately spread across
+// every shard (that's the point of Cluster), so the keys a prefix scan
+// would touch aren't knowable up front and can't be declared to EVAL's
+// KEYS - without that declaration the script only ever runs against
+// whichever single node Redis happens to pick, silently ignoring every
+// other shard. So Cluster mode falls back to the same client-side
+// RandomKeys+Del+MSet dance LevelDB/memory use, trading the atomicity for
+// correctness.
+func (s redisQueueStore) PopRandomInto(dst QueueStore, n int, val string) (moved []string, err error) {
+	other, ok := dst.(redisQueueStore)
+	if !ok {
+		err = errors.New("PopRandomInto requires a redisQueueStore destination")
+		return
+	}
+	if s.prefix != "" {
+		return genericPopRandomInto(s, other, n, val)
+	}
+	raw, err := popRandomSingleDB.Run(s.client, nil, s.db, other.db, n, val).Result()
+	if err != nil {
+		return nil, err
+	}
+	items, _ := raw.([]interface{})
+	moved = make([]string, len(items))
+	for i, item := range items {
+		moved[i], _ = item.(string)
+	}
+	return
+}
+
+// moveKeysSingleDB is popRandomSingleDB's counterpart for a caller-supplied
+// key list instead of RANDOMKEY: it deletes each key (skipping any that no
+// longer exist, e.g. an already-reaped lease) from ARGV[1]'s DB and writes
+// it into ARGV[2]'s DB with value ARGV[3], all in one EVAL, then SELECTs
+// back to ARGV[1] for the same pooled-connection reason popRandomSingleDB
+// does.
+var moveKeysSingleDB = redis.NewScript(`
+local moved = {}
+redis.call('SELECT', ARGV[1])
+for i = 4, #ARGV do
+	local k = ARGV[i]
+	if redis.call('EXISTS', k) == 1 then
+		redis.call('DEL', k)
+		table.insert(moved, k)
+	end
+end
+redis.call('SELECT', ARGV[2])
+for _, k in ipairs(moved) do
+	redis.call('SET', k, ARGV[3])
+end
+redis.call('SELECT', ARGV[1])
+return moved
+`)
+
+// MoveInto atomically moves the given keys from this space into dst. In
+// single-node and Sentinel mode it uses moveKeysSingleDB, the same
+// crash-safety guarantee PopRandomInto gives the initial todo->doing pop:
+// reapOnce relies on this to recover a stale doing lease back into todo
+// without a window where the key exists in neither store. Cluster mode has
+// no atomic equivalent here (the keys span shards the same way
+// PopRandomInto's do) and falls back to genericMoveInto's separate
+// Del-then-MSet - a dcrawl process (or the whole reaper) that crashes
+// between those two calls in Cluster mode can still drop a lease, unlike
+// single-node/Sentinel.
+func (s redisQueueStore) MoveInto(dst QueueStore, keys []string, val string) error {
+	other, ok := dst.(redisQueueStore)
+	if !ok {
+		return errors.New("MoveInto requires a redisQueueStore destination")
+	}
+	if s.prefix != "" {
+		return genericMoveInto(s, other, keys, val)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 3+len(keys))
+	args = append(args, s.db, other.db, val)
+	for _, k := range keys {
+		args = append(args, s.key(k))
+	}
+	return moveKeysSingleDB.Run(s.client, nil, args...).Err()
+}
+
+// reserveScript implements Reserve atomically: it only advances the key's
+// "next allowed" time if now has reached it, so two workers racing to check
+// the same host can't both be told they're clear to go.
+var reserveScript = redis.NewScript(`
+local next = tonumber(redis.call('GET', KEYS[1]))
+local now = tonumber(ARGV[1])
+if next and now < next then
+	return 0
+end
+redis.call('SET', KEYS[1], now + tonumber(ARGV[2]))
+return 1
+`)
+
+func (s redisQueueStore) Reserve(key string, now time.Time, delay time.Duration) (bool, error) {
+	res, err := reserveScript.Run(s.client, []string{s.key(key)}, now.UnixNano(), delay.Nanoseconds()).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.(int64)
+	return n == 1, nil
+}
+
+// memoryQueueStore is a QueueStore backed by a plain map, for running
+// dcrawl single-shot with no persistence at all.
+type memoryQueueStore struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+func newMemoryQueueStore() *memoryQueueStore {
+	return &memoryQueueStore{data: make(map[string]string)}
+}
+
+func (s *memoryQueueStore) Get(key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (s *memoryQueueStore) Set(key, val string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = val
+	return nil
+}
+
+func (s *memoryQueueStore) Del(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		delete(s.data, k)
+	}
+	return nil
+}
+
+func (s *memoryQueueStore) MSet(pairs map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range pairs {
+		s.data[k] = v
+	}
+	return nil
+}
+
+func (s *memoryQueueStore) Keys(pattern string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		if matchKeyPattern(pattern, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryQueueStore) RandomKey() (string, error) {
+	keys, err := s.RandomKeys(1)
+	if err != nil || len(keys) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return keys[0], nil
+}
+
+func (s *memoryQueueStore) RandomKeys(n int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys, nil
+}
+
+func (s *memoryQueueStore) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *memoryQueueStore) PopRandomInto(dst QueueStore, n int, val string) ([]string, error) {
+	return genericPopRandomInto(s, dst, n, val)
+}
+
+func (s *memoryQueueStore) MoveInto(dst QueueStore, keys []string, val string) error {
+	return genericMoveInto(s, dst, keys, val)
+}
+
+func (s *memoryQueueStore) Reserve(key string, now time.Time, delay time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.data[key]; ok {
+		if next, err := strconv.ParseInt(v, 10, 64); err == nil && now.UnixNano() < next {
+			return false, nil
+		}
+	}
+	s.data[key] = strconv.FormatInt(now.Add(delay).UnixNano(), 10)
+	return true, nil
+}
+
+func (s *memoryQueueStore) FlushAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = make(map[string]string)
+	return nil
+}
+
+type memoryQueueIterator struct {
+	keys []string
+	i    int
+}
+
+func (s *memoryQueueStore) Scan() QueueIterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	return &memoryQueueIterator{keys: keys, i: -1}
+}
+
+// ScanBatch ignores batchSize: there's no server round-trip to batch, since
+// a memoryQueueStore's whole keyspace already lives in this process.
+func (s *memoryQueueStore) ScanBatch(batchSize int) QueueIterator {
+	return s.Scan()
+}
+
+func (it *memoryQueueIterator) Next() bool {
+	it.i++
+	return it.i < len(it.keys)
+}
+func (it *memoryQueueIterator) Val() string { return it.keys[it.i] }
+func (it *memoryQueueIterator) Err() error  { return nil }
+
+// levelDBQueueStore is a QueueStore backed by an embedded LevelDB, so a
+// single-host crawl can run without any external Redis dependency.
+type levelDBQueueStore struct {
+	db *leveldb.DB
+	mu sync.Mutex
+}
+
+func newLevelDBQueueStore(dir string) (*levelDBQueueStore, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBQueueStore{db: db}, nil
+}
+
+func (s *levelDBQueueStore) Get(key string) (string, error) {
+	v, err := s.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return "", ErrKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+func (s *levelDBQueueStore) Set(key, val string) error {
+	return s.db.Put([]byte(key), []byte(val), nil)
+}
+
+func (s *levelDBQueueStore) Del(keys ...string) error {
+	batch := new(leveldb.Batch)
+	for _, k := range keys {
+		batch.Delete([]byte(k))
+	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *levelDBQueueStore) MSet(pairs map[string]string) error {
+	batch := new(leveldb.Batch)
+	for k, v := range pairs {
+		batch.Put([]byte(k), []byte(v))
+	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *levelDBQueueStore) Keys(pattern string) (keys []string, err error) {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := string(iter.Key())
+		if matchKeyPattern(pattern, k) {
+			keys = append(keys, k)
+		}
+	}
+	err = iter.Error()
+	return
+}
+
+func (s *levelDBQueueStore) RandomKey() (string, error) {
+	keys, err := s.RandomKeys(1)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return keys[0], nil
+}
+
+// RandomKeys reservoir-samples up to n keys in a single pass over the
+// keyspace, so it doesn't need to materialize every key to pick a few.
+func (s *levelDBQueueStore) RandomKeys(n int) (keys []string, err error) {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	reservoir := make([]string, 0, n)
+	i := 0
+	for iter.Next() {
+		k := string(iter.Key())
+		if len(reservoir) < n {
+			reservoir = append(reservoir, k)
+		} else if j := rand.Intn(i + 1); j < n {
+			reservoir[j] = k
+		}
+		i++
+	}
+	err = iter.Error()
+	keys = reservoir
+	return
+}
+
+func (s *levelDBQueueStore) PopRandomInto(dst QueueStore, n int, val string) ([]string, error) {
+	return genericPopRandomInto(s, dst, n, val)
+}
+
+func (s *levelDBQueueStore) MoveInto(dst QueueStore, keys []string, val string) error {
+	return genericMoveInto(s, dst, keys, val)
+}
+
+// Reserve is guarded by s.mu since a LevelDB get-then-put isn't atomic on
+// its own; that's sufficient here because LevelDB only ever backs a single
+// dcrawl process anyway.
+func (s *levelDBQueueStore) Reserve(key string, now time.Time, delay time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, err := s.db.Get([]byte(key), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return false, err
+	}
+	if err == nil {
+		if next, errParse := strconv.ParseInt(string(v), 10, 64); errParse == nil && now.UnixNano() < next {
+			return false, nil
+		}
+	}
+	return true, s.db.Put([]byte(key), []byte(strconv.FormatInt(now.Add(delay).UnixNano(), 10)), nil)
+}
+
+func (s *levelDBQueueStore) Size() (int64, error) {
+	var n int64
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		n++
+	}
+	return n, iter.Error()
+}
+
+func (s *levelDBQueueStore) FlushAll() error {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+type levelDBQueueIterator struct {
+	iter iterator.Iterator
+}
+
+func (s *levelDBQueueStore) Scan() QueueIterator {
+	return &levelDBQueueIterator{iter: s.db.NewIterator(nil, nil)}
+}
+
+// ScanBatch ignores batchSize: LevelDB's iterator already streams off disk
+// without a separate paging round-trip to tune.
+func (s *levelDBQueueStore) ScanBatch(batchSize int) QueueIterator {
+	return s.Scan()
+}
+
+func (it *levelDBQueueIterator) Next() bool  { return it.iter.Next() }
+func (it *levelDBQueueIterator) Val() string { return string(it.iter.Key()) }
+func (it *levelDBQueueIterator) Err() error  { return it.iter.Error() }
@@ -0,0 +1,78 @@
+package dcrawl
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/willf/bloom"
+)
+
+// seenCache is a local, best-effort "have we seen this URL" check that sits
+// in front of the four Redis lookups addLinkToDo would otherwise make for
+// every discovered link. It never needs to forget a URL mid-crawl: dcrawl
+// never removes URLs from done/trash once they land there, so there's no
+// expiry to worry about, only eviction of the least-recently-used entries
+// once the LRU fills up.
+type seenCache struct {
+	recent *lru.Cache
+	// bloomMu guards bloom: lru.Cache does its own internal locking, but
+	// bloom.BloomFilter has none, and MaybeSeen/Add are called concurrently
+	// from every crawl() worker goroutine.
+	bloomMu sync.Mutex
+	bloom   *bloom.BloomFilter
+}
+
+// newSeenCache builds a seenCache with an LRU of lruSize entries, plus (if
+// bloomItems > 0) a Bloom filter sized for roughly bloomItems URLs at
+// bloomFalsePositiveRate. A lruSize of 0 disables the cache entirely.
+func newSeenCache(lruSize int, bloomItems uint, bloomFalsePositiveRate float64) (*seenCache, error) {
+	if lruSize <= 0 {
+		return nil, nil
+	}
+	recent, err := lru.New(lruSize)
+	if err != nil {
+		return nil, err
+	}
+	c := &seenCache{recent: recent}
+	if bloomItems > 0 {
+		c.bloom = bloom.NewWithEstimates(bloomItems, bloomFalsePositiveRate)
+	}
+	return c, nil
+}
+
+// MaybeSeen reports whether link is in the local cache: recorded by Add and
+// not yet evicted from the LRU, or matched by the Bloom filter, which can
+// false-positive at roughly bloomFalsePositiveRate. A false says nothing
+// about the backend, since the LRU may have evicted the entry or the link
+// may have been filed by an earlier run or another process. A nil cache
+// reports true.
+func (c *seenCache) MaybeSeen(link string) bool {
+	if c == nil {
+		return true
+	}
+	if c.recent.Contains(link) {
+		return true
+	}
+	if c.bloom != nil {
+		c.bloomMu.Lock()
+		seen := c.bloom.TestString(link)
+		c.bloomMu.Unlock()
+		if seen {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records that link has been filed into one of the four spaces.
+func (c *seenCache) Add(link string) {
+	if c == nil {
+		return
+	}
+	c.recent.Add(link, struct{}{})
+	if c.bloom != nil {
+		c.bloomMu.Lock()
+		c.bloom.AddString(link)
+		c.bloomMu.Unlock()
+	}
+}